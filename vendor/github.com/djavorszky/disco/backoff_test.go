@@ -0,0 +1,26 @@
+package disco
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 250 * time.Millisecond},
+		{1, 500 * time.Millisecond},
+		{2, time.Second},
+		{3, 2 * time.Second},
+		{4, 2 * time.Second},
+		{10, 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := queryBackoff(tt.attempt); got != tt.want {
+			t.Errorf("queryBackoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
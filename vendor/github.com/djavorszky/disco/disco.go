@@ -1,11 +1,21 @@
 package disco
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 // MaxDatagramSize sets the maximum amount of bytes to be read
@@ -32,22 +42,164 @@ const (
 type Service struct {
 	Name string
 	Addr string
+
+	// Meta carries the key=value pairs the service was announced with,
+	// analogous to a DNS-SD TXT record. It is nil if the service was
+	// announced without metadata.
+	Meta map[string]string
+}
+
+// Protocol selects the wire format that Announce and Query (and their
+// Context variants) speak on the wire. Respond, ListenFor, Subscribe and
+// Broadcast always use the custom protocol.
+type Protocol int
+
+const (
+	// ProtocolCustom is disco's original srvc;type;srcAddr;name text
+	// protocol. It is the default, so existing callers are unaffected.
+	ProtocolCustom Protocol = iota
+
+	// ProtocolMDNS speaks standards-compliant mDNS/DNS-SD (RFC 6762/6763)
+	// over 224.0.0.251:5353 / [ff02::fb]:5353, so services can be found
+	// by stock OS tooling such as Bonjour or Avahi.
+	ProtocolMDNS
+)
+
+// Option configures optional behavior of disco's exported functions
+// without changing their existing call signatures.
+type Option func(*options)
+
+type options struct {
+	protocol   Protocol
+	interfaces []*net.Interface
+	networks   []string
+}
+
+func buildOptions(opts []Option) options {
+	o := options{protocol: ProtocolCustom}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if len(o.networks) == 0 {
+		o.networks = []string{"udp4", "udp6"}
+	}
+
+	return o
+}
+
+// WithProtocol selects which wire protocol an operation should use.
+func WithProtocol(p Protocol) Option {
+	return func(o *options) { o.protocol = p }
+}
+
+// WithInterfaces restricts Subscribe, Announce and Broadcast to the given
+// network interfaces. Without this option, they autodetect and use every
+// up, multicast-capable, non-loopback interface on the host.
+func WithInterfaces(ifaces ...*net.Interface) Option {
+	return func(o *options) { o.interfaces = ifaces }
+}
+
+// WithNetworks restricts Subscribe, Announce and Broadcast to the given
+// address families ("udp4", "udp6"). Without this option, both are used;
+// whichever doesn't match the multicast address in play is simply skipped.
+func WithNetworks(networks ...string) Option {
+	return func(o *options) { o.networks = networks }
+}
+
+// resolveInterfaces expands the interfaces requested via WithInterfaces,
+// or autodetects every up, multicast-capable, non-loopback interface if
+// none were requested. If autodetection finds none - some container and
+// veth interfaces support multicast without advertising FlagMulticast -
+// it falls back to a single nil entry, meaning "let the OS pick", which
+// is how Subscribe and Broadcast behaved before WithInterfaces existed.
+func resolveInterfaces(requested []*net.Interface) ([]*net.Interface, error) {
+	if len(requested) > 0 {
+		return requested, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("interfaces: %v", err)
+	}
+
+	if up := usableInterfaces(all); len(up) > 0 {
+		return up, nil
+	}
+
+	return []*net.Interface{nil}, nil
+}
+
+// usableInterfaces filters all down to the up, multicast-capable,
+// non-loopback interfaces, pulled out of resolveInterfaces so it can be
+// exercised with a fake interface list.
+func usableInterfaces(all []net.Interface) []*net.Interface {
+	const want = net.FlagUp | net.FlagMulticast
+
+	var up []*net.Interface
+	for i := range all {
+		iface := all[i]
+		if iface.Flags&want != want || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		up = append(up, &iface)
+	}
+
+	return up
+}
+
+// networkFor returns the "udp4"/"udp6" network matching addr's family.
+func networkFor(addr *net.UDPAddr) string {
+	if addr.IP.To4() != nil {
+		return "udp4"
+	}
+
+	return "udp6"
+}
+
+func containsNetwork(networks []string, network string) bool {
+	for _, n := range networks {
+		if n == network {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ifaceFromSrc extracts the interface name tagged onto a MulticastMsg.Src
+// value of "ip:port%iface", as produced when Subscribe listens across
+// multiple interfaces. It returns "" if src carries no such tag.
+func ifaceFromSrc(src string) string {
+	if i := strings.LastIndexByte(src, '%'); i >= 0 {
+		return src[i+1:]
+	}
+
+	return ""
 }
 
 type srvc struct {
 	typ     string
 	srcAddr string
 	name    string
+	meta    map[string]string
 }
 
 func (s srvc) String() string {
-	return fmt.Sprintf("srvc;%s;%s;%s", s.typ, s.srcAddr, s.name)
+	if len(s.meta) == 0 {
+		return fmt.Sprintf("srvc;%s;%s;%s", s.typ, s.srcAddr, s.name)
+	}
+
+	return fmt.Sprintf("srvc;%s;%s;%s;%s", s.typ, s.srcAddr, s.name, encodeMeta(s.meta))
 }
 
 func srvcFrom(msg string) (srvc, error) {
-	ss := strings.Split(msg, ";")
+	// SplitN rather than Split so that messages without the optional
+	// 5th (metadata) field still parse exactly as before.
+	ss := strings.SplitN(msg, ";", 5)
 
-	if len(ss) != 4 || ss[0] != "srvc" {
+	if len(ss) < 4 || ss[0] != "srvc" {
 		return srvc{}, fmt.Errorf("missing protocol declaration")
 	}
 
@@ -55,82 +207,313 @@ func srvcFrom(msg string) (srvc, error) {
 		return srvc{}, fmt.Errorf("missing query type, address or name")
 	}
 
-	return srvc{typ: ss[1], srcAddr: ss[2], name: ss[3]}, nil
+	s := srvc{typ: ss[1], srcAddr: ss[2], name: ss[3]}
 
+	if len(ss) == 5 && ss[4] != "" {
+		meta, err := decodeMeta(ss[4])
+		if err != nil {
+			return srvc{}, fmt.Errorf("metadata: %v", err)
+		}
+
+		s.meta = meta
+	}
+
+	return s, nil
+}
+
+// encodeMeta serializes metadata into the base64-encoded, length-prefixed
+// key=value block carried as the optional 5th field of the srvc wire
+// format.
+func encodeMeta(meta map[string]string) string {
+	if len(meta) == 0 {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for k, v := range meta {
+		kv := k + "=" + v
+		binary.Write(&buf, binary.BigEndian, uint16(len(kv)))
+		buf.WriteString(kv)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// decodeMeta is the inverse of encodeMeta.
+func decodeMeta(blob string) (map[string]string, error) {
+	raw, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata encoding: %v", err)
+	}
+
+	meta := make(map[string]string)
+
+	buf := bytes.NewReader(raw)
+	for buf.Len() > 0 {
+		var n uint16
+		if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+			return nil, fmt.Errorf("truncated metadata length prefix: %v", err)
+		}
+
+		kv := make([]byte, n)
+		if _, err := io.ReadFull(buf, kv); err != nil {
+			return nil, fmt.Errorf("truncated metadata entry: %v", err)
+		}
+
+		parts := strings.SplitN(string(kv), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed metadata entry %q", kv)
+		}
+
+		meta[parts[0]] = parts[1]
+	}
+
+	return meta, nil
+}
+
+// Handle represents a running AnnounceContext call. Stop deregisters the
+// service's background query responder and blocks until it, and the UDP
+// socket it used, have shut down.
+type Handle struct {
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+}
+
+// Stop cancels the announcement's background query responder and waits
+// for it to exit. Cancelling the context passed to AnnounceContext has
+// the same effect.
+func (h *Handle) Stop() {
+	h.cancel()
+	h.wg.Wait()
 }
 
 // Announce sends out an announcement on the mAddr
 // that other clients can listen to. ListenFor can interpret
-// these srvc messages
-func Announce(mAddr, srcAddr, name string) error {
+// these srvc messages. meta is advertised alongside the service, analogous
+// to a DNS-SD TXT record, and may be nil. Passing WithProtocol(ProtocolMDNS)
+// announces over mDNS/DNS-SD instead, and mAddr is ignored in that case.
+//
+// The background query responder it starts runs for the lifetime of the
+// process; use AnnounceContext to stop it.
+func Announce(mAddr, srcAddr, name string, meta map[string]string, opts ...Option) error {
+	_, err := AnnounceContext(context.Background(), mAddr, srcAddr, name, meta, opts...)
+	return err
+}
+
+// AnnounceContext is like Announce, but the returned Handle's Stop method
+// (or cancelling ctx) stops the background query responder and releases
+// its UDP socket.
+func AnnounceContext(ctx context.Context, mAddr, srcAddr, name string, meta map[string]string, opts ...Option) (*Handle, error) {
 	if name == "" {
-		return fmt.Errorf("announce: empty name is not valid")
+		return nil, fmt.Errorf("announce: empty name is not valid")
+	}
+
+	o := buildOptions(opts)
+	if o.protocol == ProtocolMDNS {
+		return mdnsAnnounceContext(ctx, srcAddr, name, meta)
 	}
 
-	go respondToQueries(mAddr, srcAddr, name)
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		respondToQueries(ctx, mAddr, srcAddr, name, meta, opts)
+	}()
+
+	if err := Broadcast(mAddr, srvc{typ: TypeAnnounce, name: name, srcAddr: srcAddr, meta: meta}.String(), opts...); err != nil {
+		cancel()
+		wg.Wait()
+
+		return nil, err
+	}
 
-	return Broadcast(mAddr, srvc{typ: TypeAnnounce, name: name, srcAddr: srcAddr}.String())
+	return &Handle{cancel: cancel, wg: &wg}, nil
 }
 
-func respondToQueries(mAddr, srcAddr, name string) {
-	msgs, err := Subscribe(mAddr)
+func respondToQueries(ctx context.Context, mAddr, srcAddr, name string, meta map[string]string, opts []Option) {
+	msgs, err := SubscribeContext(ctx, mAddr, opts...)
 	if err != nil {
 		log.Printf("Failed to subscribe to %q: %v", mAddr, err)
+		return
 	}
 
 	for {
-		msg := <-msgs
-		service, err := srvcFrom(msg.Message)
-		if err != nil {
-			continue
-		}
+		select {
+		case <-ctx.Done():
+			// Wait for the subscription to close its sockets, so that
+			// Handle.Stop returns only once they are released.
+			for range msgs {
+			}
+
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
 
-		if service.typ == TypeReport || (service.typ == TypeQuery && service.name == name) {
-			err = Respond(mAddr, srcAddr, name)
+			service, err := srvcFrom(msg.Message)
 			if err != nil {
-				log.Printf("respondToQueries: %v", err)
+				continue
+			}
+
+			if service.typ == TypeReport || (service.typ == TypeQuery && service.name == name) {
+				// Answer on every interface, including the one the
+				// query arrived on, since that is where the asker is.
+				response := srvc{typ: TypeResponse, srcAddr: srcAddr, name: name, meta: meta}
+				if err := broadcast(mAddr, response.String(), "", opts); err != nil {
+					log.Printf("respondToQueries: %v", err)
+				}
 			}
 		}
 	}
 }
 
+// ErrTimeout is returned by Query, QueryContext and the mDNS query path
+// when no response arrives before the timeout elapses.
+var ErrTimeout = errors.New("disco: query timed out")
+
+// maxQueryRetries bounds how many times QueryContext retransmits its
+// query broadcast before falling back to just waiting out the timeout.
+const maxQueryRetries = 6
+
+// queryBackoff returns retransmit's delay for the given zero-indexed
+// attempt: 250ms, 500ms, 1s, 2s, then capped at 2s.
+func queryBackoff(attempt int) time.Duration {
+	d := 250 * time.Millisecond
+	for i := 0; i < attempt && d < 2*time.Second; i++ {
+		d *= 2
+	}
+
+	if d > 2*time.Second {
+		d = 2 * time.Second
+	}
+
+	return d
+}
+
+// retransmit re-broadcasts query, restricted to opts' interfaces and
+// networks, with exponential backoff until ctx is done or, if
+// maxRetries is positive, until that many attempts have been made.
+func retransmit(ctx context.Context, mAddr string, query srvc, maxRetries int, opts []Option) {
+	for attempt := 0; maxRetries <= 0 || attempt < maxRetries; attempt++ {
+		timer := time.NewTimer(queryBackoff(attempt))
+
+		select {
+		case <-timer.C:
+			Broadcast(mAddr, query.String(), opts...)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
 // Query sends out a query type broadcast and waits up until timeout
-// for a response.
-func Query(mAddr, srcAddr, name string, timeout time.Duration) (Service, error) {
-	query := srvc{typ: TypeQuery, srcAddr: srcAddr, name: name}
+// for a response, retransmitting with exponential backoff in the
+// meantime. Passing WithProtocol(ProtocolMDNS) queries over mDNS/DNS-SD
+// instead, and mAddr and srcAddr are ignored in that case.
+func Query(mAddr, srcAddr, name string, timeout time.Duration, opts ...Option) (Service, error) {
+	return QueryContext(context.Background(), mAddr, srcAddr, name, timeout, opts...)
+}
 
-	retry := time.NewTicker(500 * time.Millisecond)
-	defer retry.Stop()
+// QueryContext is like Query, but cancelling ctx (in addition to timeout
+// elapsing) stops the retransmit loop and the underlying ListenFor
+// socket - or, for ProtocolMDNS, the underlying mDNS query socket.
+func QueryContext(ctx context.Context, mAddr, srcAddr, name string, timeout time.Duration, opts ...Option) (Service, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	wait := time.After(timeout)
+	o := buildOptions(opts)
+	if o.protocol == ProtocolMDNS {
+		return mdnsQueryContext(ctx, name)
+	}
+
+	query := srvc{typ: TypeQuery, srcAddr: srcAddr, name: name}
 
-	c, err := ListenFor(mAddr, name)
+	c, err := ListenForContext(ctx, mAddr, opts, name)
 	if err != nil {
 		return Service{}, fmt.Errorf("listenfor: %v", err)
 	}
 
-	err = Broadcast(mAddr, query.String())
-	if err != nil {
+	if err := Broadcast(mAddr, query.String(), opts...); err != nil {
 		return Service{}, fmt.Errorf("query: %v", err)
 	}
 
-	go func() {
-		for range retry.C {
-			Broadcast(mAddr, query.String())
-		}
-	}()
+	go retransmit(ctx, mAddr, query, maxQueryRetries, opts)
 
 	select {
-	case found := <-c:
+	case found, ok := <-c:
+		if !ok {
+			return Service{}, ErrTimeout
+		}
+
 		return found, nil
-	case <-wait:
-		return Service{}, fmt.Errorf("RESPONSE_TIMEOUT")
+	case <-ctx.Done():
+		return Service{}, ErrTimeout
 	}
 }
 
-// Respond sends a response type broadcast
-func Respond(mAddr, srcAddr, name string) error {
-	err := Broadcast(mAddr, srvc{typ: TypeResponse, srcAddr: srcAddr, name: name}.String())
+// QueryAll is like Query, but instead of returning the first responder it
+// keeps retransmitting and collecting responses on the returned channel
+// until ctx is cancelled. It's useful for "find every instance of service
+// X" rather than just the first, and the returned channel is closed once
+// ctx is done.
+func QueryAll(ctx context.Context, mAddr, name string) <-chan Service {
+	out := make(chan Service)
+
+	go func() {
+		defer close(out)
+
+		msgs, err := SubscribeContext(ctx, mAddr)
+		if err != nil {
+			return
+		}
+
+		query := srvc{typ: TypeQuery, srcAddr: "-", name: name}
+		if err := Broadcast(mAddr, query.String()); err != nil {
+			return
+		}
+
+		go retransmit(ctx, mAddr, query, 0, nil)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+
+				service, err := srvcFrom(msg.Message)
+				if err != nil {
+					continue
+				}
+
+				if service.name != name || (service.typ != TypeAnnounce && service.typ != TypeResponse) {
+					continue
+				}
+
+				svc := Service{Name: service.name, Addr: service.srcAddr, Meta: service.meta}
+
+				select {
+				case out <- svc:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// Respond sends a response type broadcast. meta is advertised alongside
+// the service and may be nil.
+func Respond(mAddr, srcAddr, name string, meta map[string]string) error {
+	err := Broadcast(mAddr, srvc{typ: TypeResponse, srcAddr: srcAddr, name: name, meta: meta}.String())
 	if err != nil {
 		return fmt.Errorf("response: %v", err)
 	}
@@ -141,67 +524,162 @@ func Respond(mAddr, srcAddr, name string) error {
 // ListenFor returns a channel that sends a message if any of the
 // names that was requested has announced itself on the multicast
 // addr. Once announced, the whole message will be returned and then
-// removed from the watchlist
+// removed from the watchlist.
+//
+// The subscription runs for the lifetime of the process; use
+// ListenForContext to stop it.
 func ListenFor(addr string, names ...string) (<-chan Service, error) {
-	recv, err := Subscribe(addr)
+	return ListenForContext(context.Background(), addr, nil, names...)
+}
+
+// ListenForContext is like ListenFor, but cancelling ctx closes the
+// returned channel and releases the underlying UDP socket. opts
+// restricts which interfaces and networks the underlying subscription
+// uses, exactly as with Subscribe; WithProtocol has no effect here, and
+// only custom-protocol announcements are reported.
+func ListenForContext(ctx context.Context, addr string, opts []Option, names ...string) (<-chan Service, error) {
+	recv, err := SubscribeContext(ctx, addr, opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	send := make(chan Service)
-	go listenfor(recv, send, names)
+	go listenfor(ctx, recv, send, names)
 
 	return send, nil
 }
 
-func listenfor(recv <-chan MulticastMsg, send chan<- Service, names []string) {
-	mapping := make(map[string]bool)
+func listenfor(ctx context.Context, recv <-chan MulticastMsg, send chan<- Service, names []string) {
+	defer close(send)
 
+	mapping := make(map[string]bool, len(names))
 	for _, name := range names {
 		mapping[name] = true
 	}
 
 	for {
-		msg := <-recv
-		srvc, err := srvcFrom(msg.Message)
-		if err != nil {
-			continue
-		}
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-recv:
+			if !ok {
+				return
+			}
 
-		if srvc.typ != TypeAnnounce {
-			continue
-		}
+			srvc, err := srvcFrom(msg.Message)
+			if err != nil {
+				continue
+			}
 
-		if _, ok := mapping[srvc.name]; ok {
-			send <- Service{Name: srvc.name, Addr: srvc.srcAddr}
-			delete(mapping, srvc.name)
-		}
+			if srvc.typ != TypeAnnounce {
+				continue
+			}
 
-		if len(mapping) == 0 {
-			close(send)
-			return
+			if _, ok := mapping[srvc.name]; ok {
+				select {
+				case send <- Service{Name: srvc.name, Addr: srvc.srcAddr, Meta: srvc.meta}:
+				case <-ctx.Done():
+					return
+				}
+
+				delete(mapping, srvc.name)
+			}
+
+			if len(mapping) == 0 {
+				return
+			}
 		}
 	}
 }
 
-// Broadcast sends a message to the multicast address
-// via UDP. The address should be in an "ipaddr:port" fashion
-func Broadcast(addr, message string) error {
+// Broadcast sends a message to the multicast address via UDP, fanning it
+// out over every resolved interface (see WithInterfaces, WithNetworks).
+// The address should be in an "ipaddr:port" fashion.
+func Broadcast(addr, message string, opts ...Option) error {
+	return broadcast(addr, message, "", opts)
+}
+
+// broadcast is Broadcast's implementation. excludeIface, if non-empty,
+// is skipped, so callers can avoid echoing a message back out the
+// interface it was received on.
+func broadcast(addr, message, excludeIface string, opts []Option) error {
+	if len(message) > MaxDatagramSize {
+		return fmt.Errorf("broadcast: message of %d bytes exceeds MaxDatagramSize (%d)", len(message), MaxDatagramSize)
+	}
+
+	o := buildOptions(opts)
+
 	udpAddr, err := resolve(addr)
 	if err != nil {
 		return fmt.Errorf("broadcast: %v", err)
 	}
 
-	c, err := net.DialUDP("udp", nil, udpAddr)
+	network := networkFor(udpAddr)
+	if !containsNetwork(o.networks, network) {
+		return fmt.Errorf("broadcast: %s (%s) does not match requested network(s) %v", addr, network, o.networks)
+	}
+
+	ifaces, err := resolveInterfaces(o.interfaces)
 	if err != nil {
-		return fmt.Errorf("broadcast dial %q: %v", addr, err)
+		return fmt.Errorf("broadcast: %v", err)
+	}
+
+	var sent int
+	var lastErr error
+	for _, iface := range ifaces {
+		ifaceName := "default"
+		if iface != nil {
+			ifaceName = iface.Name
+			if ifaceName == excludeIface {
+				continue
+			}
+		}
+
+		if err := sendOn(network, iface, udpAddr, []byte(message)); err != nil {
+			lastErr = fmt.Errorf("%s: %v", ifaceName, err)
+			continue
+		}
+
+		sent++
+	}
+
+	if sent == 0 && lastErr != nil {
+		return fmt.Errorf("broadcast: %v", lastErr)
 	}
-	c.Write([]byte(message))
-	c.Close()
 
 	return nil
 }
 
+// sendOn multicasts payload to dst, using iface as the outgoing
+// multicast interface. A nil iface lets the OS pick.
+func sendOn(network string, iface *net.Interface, dst *net.UDPAddr, payload []byte) error {
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if network == "udp6" {
+		p := ipv6.NewPacketConn(conn)
+		if err := p.SetMulticastInterface(iface); err != nil {
+			return err
+		}
+
+		_, err = p.WriteTo(payload, nil, dst)
+
+		return err
+	}
+
+	p := ipv4.NewPacketConn(conn)
+	if err := p.SetMulticastInterface(iface); err != nil {
+		return err
+	}
+
+	_, err = p.WriteTo(payload, nil, dst)
+
+	return err
+}
+
 // MulticastMsg is used to communicate a message that was
 // received on a multicast channel. Contains information
 // about the sender as well, or an error if any arose.
@@ -211,17 +689,71 @@ type MulticastMsg struct {
 	Err     error
 }
 
-// Subscribe starts listening to a multicast address via
-// UDP. The address should be in an "ipaddr:port" fashion.
-func Subscribe(addr string) (<-chan MulticastMsg, error) {
+// Subscribe starts listening to a multicast address via UDP. The address
+// should be in an "ipaddr:port" fashion. It listens across every resolved
+// interface (see WithInterfaces, WithNetworks), tagging MulticastMsg.Src
+// with the receiving interface's name.
+//
+// The subscription, and the UDP sockets backing it, run for the lifetime
+// of the process; use SubscribeContext to stop it.
+func Subscribe(addr string, opts ...Option) (<-chan MulticastMsg, error) {
+	return SubscribeContext(context.Background(), addr, opts...)
+}
+
+// SubscribeContext is like Subscribe, but cancelling ctx closes the
+// returned channel and releases the underlying UDP sockets.
+func SubscribeContext(ctx context.Context, addr string, opts ...Option) (<-chan MulticastMsg, error) {
+	o := buildOptions(opts)
+
 	udpAddr, err := resolve(addr)
 	if err != nil {
 		return nil, fmt.Errorf("subscribe: %v", err)
 	}
 
+	network := networkFor(udpAddr)
+	if !containsNetwork(o.networks, network) {
+		return nil, fmt.Errorf("subscribe: %s (%s) does not match requested network(s) %v", addr, network, o.networks)
+	}
+
+	ifaces, err := resolveInterfaces(o.interfaces)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe: %v", err)
+	}
+
 	c := make(chan MulticastMsg)
 
-	go listen(udpAddr, c)
+	var wg sync.WaitGroup
+	var listening int
+	for _, iface := range ifaces {
+		ifaceName := "default"
+		if iface != nil {
+			ifaceName = iface.Name
+		}
+
+		l, err := net.ListenMulticastUDP(network, iface, udpAddr)
+		if err != nil {
+			log.Printf("subscribe: %s: %v", ifaceName, err)
+			continue
+		}
+		l.SetReadBuffer(MaxDatagramSize)
+
+		listening++
+
+		wg.Add(1)
+		go func(ifaceName string, l *net.UDPConn) {
+			defer wg.Done()
+			listen(ctx, ifaceName, l, c)
+		}(ifaceName, l)
+	}
+
+	if listening == 0 {
+		return nil, fmt.Errorf("subscribe: failed to listen on any of %d interface(s)", len(ifaces))
+	}
+
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
 
 	return c, nil
 }
@@ -235,25 +767,37 @@ func resolve(addr string) (*net.UDPAddr, error) {
 	return a, nil
 }
 
-func listen(addr *net.UDPAddr, c chan MulticastMsg) {
-	l, err := net.ListenMulticastUDP("udp", nil, addr)
-	if err != nil {
-		c <- MulticastMsg{Err: fmt.Errorf("listen: %v", err)}
-		close(c)
-	}
-	l.SetReadBuffer(MaxDatagramSize)
+func listen(ctx context.Context, ifaceName string, l *net.UDPConn, c chan<- MulticastMsg) {
+	closed := make(chan struct{})
+	defer close(closed)
+	defer l.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.SetReadDeadline(time.Now())
+			l.Close()
+		case <-closed:
+		}
+	}()
 
 	for {
 		msg := make([]byte, MaxDatagramSize)
 		n, src, err := l.ReadFromUDP(msg)
 		if err != nil {
-			c <- MulticastMsg{Err: fmt.Errorf("read: %v", err)}
-			close(c)
+			select {
+			case <-ctx.Done():
+			default:
+				c <- MulticastMsg{Err: fmt.Errorf("read: %v", err)}
+			}
+
+			return
 		}
 
-		c <- MulticastMsg{
-			Message: string(msg[:n]),
-			Src:     fmt.Sprintf("%s:%d", src.IP, src.Port),
+		select {
+		case c <- MulticastMsg{Message: string(msg[:n]), Src: fmt.Sprintf("%s:%d%%%s", src.IP, src.Port, ifaceName)}:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -0,0 +1,44 @@
+package disco
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecodeMeta(t *testing.T) {
+	tests := []struct {
+		name string
+		meta map[string]string
+	}{
+		{"nil", nil},
+		{"empty", map[string]string{}},
+		{"single", map[string]string{"version": "1.2.3"}},
+		{"multiple", map[string]string{"version": "1.2.3", "region": "eu-west-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := encodeMeta(tt.meta)
+
+			got, err := decodeMeta(encoded)
+			if err != nil {
+				t.Fatalf("decodeMeta(%q) returned error: %v", encoded, err)
+			}
+
+			want := tt.meta
+			if want == nil {
+				want = map[string]string{}
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decodeMeta(encodeMeta(%v)) = %v, want %v", tt.meta, got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeMetaInvalidEncoding(t *testing.T) {
+	if _, err := decodeMeta("not-base64!!"); err == nil {
+		t.Error("decodeMeta: expected an error for invalid base64, got nil")
+	}
+}
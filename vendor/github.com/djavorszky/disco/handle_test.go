@@ -0,0 +1,30 @@
+package disco
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestHandleStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		close(done)
+	}()
+
+	h := &Handle{cancel: cancel, wg: &wg}
+	h.Stop()
+
+	select {
+	case <-done:
+	default:
+		t.Error("Stop returned without cancelling the context first")
+	}
+}
@@ -0,0 +1,33 @@
+package disco
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUsableInterfaces(t *testing.T) {
+	all := []net.Interface{
+		{Name: "lo", Flags: net.FlagUp | net.FlagMulticast | net.FlagLoopback},
+		{Name: "down0", Flags: net.FlagMulticast},
+		{Name: "eth0", Flags: net.FlagUp | net.FlagMulticast},
+		{Name: "veth0", Flags: net.FlagUp},
+	}
+
+	up := usableInterfaces(all)
+	if len(up) != 1 || up[0].Name != "eth0" {
+		t.Errorf("usableInterfaces(%v) = %v, want only eth0", all, up)
+	}
+}
+
+func TestResolveInterfacesHonorsRequested(t *testing.T) {
+	requested := []*net.Interface{{Name: "eth1"}}
+
+	got, err := resolveInterfaces(requested)
+	if err != nil {
+		t.Fatalf("resolveInterfaces: %v", err)
+	}
+
+	if len(got) != 1 || got[0] != requested[0] {
+		t.Errorf("resolveInterfaces(%v) = %v, want requested unchanged", requested, got)
+	}
+}
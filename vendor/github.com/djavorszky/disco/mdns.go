@@ -0,0 +1,429 @@
+package disco
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mdnsV4Addr and mdnsV6Addr are the well-known mDNS multicast groups
+// defined in RFC 6762 §3.
+const (
+	mdnsV4Addr = "224.0.0.251:5353"
+	mdnsV6Addr = "[ff02::fb]:5353"
+
+	// mdnsServiceType is the DNS-SD service type disco advertises
+	// itself under; see RFC 6763 §4.1.
+	mdnsServiceType = "_disco._tcp.local."
+
+	// mdnsTTL is the record TTL used for disco's own PTR/SRV/TXT/A/AAAA
+	// records, per the RFC 6762 §10 guidance for frequently-changing data.
+	mdnsTTL = 120
+
+	// mdnsProbeTTL is how long mdnsProbe waits for a conflicting answer
+	// after sending its RFC 6762 §8.1 probe query.
+	mdnsProbeTTL = 250 * time.Millisecond
+)
+
+// instanceFQDN returns the DNS-SD service instance name for name, e.g.
+// "myservice._disco._tcp.local.".
+func instanceFQDN(name string) string {
+	return dns.Fqdn(name) + mdnsServiceType
+}
+
+// mdnsAnnounceContext probes for name on the local network and, if
+// nobody else claims it, announces srcAddr under it, then keeps a
+// responder running until ctx is cancelled so later PTR questions for
+// name get answered too. It implements a reduced form of the RFC 6762
+// §8 probing/announcing state machine: a single probe round followed
+// by two cache-flushing announcements. meta is carried in the
+// instance's TXT record and may be nil.
+func mdnsAnnounceContext(ctx context.Context, srcAddr, name string, meta map[string]string) (*Handle, error) {
+	host, portStr, err := net.SplitHostPort(srcAddr)
+	if err != nil {
+		return nil, fmt.Errorf("mdns announce: %v", err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("mdns announce: invalid port %q: %v", portStr, err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("mdns announce: invalid address %q", host)
+	}
+
+	instance := instanceFQDN(name)
+	hostFQDN := dns.Fqdn(host + ".local")
+
+	if conflict, err := mdnsProbe(instance); err != nil {
+		return nil, fmt.Errorf("mdns announce: probe: %v", err)
+	} else if conflict {
+		return nil, fmt.Errorf("mdns announce: %q is already in use on the network", name)
+	}
+
+	msg := mdnsAnnounceMsg(instance, hostFQDN, ip, uint16(port), meta)
+
+	if err := mdnsSend(ip, msg); err != nil {
+		return nil, fmt.Errorf("mdns announce: %v", err)
+	}
+
+	// RFC 6762 §8.3 requires at least two unsolicited, cache-flushing
+	// announcements one second apart.
+	time.Sleep(time.Second)
+
+	if err := mdnsSend(ip, msg); err != nil {
+		return nil, fmt.Errorf("mdns announce: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		mdnsRespond(ctx, ip, instance, msg)
+	}()
+
+	return &Handle{cancel: cancel, wg: &wg}, nil
+}
+
+// mdnsRespond answers incoming mDNS questions naming instance with msg
+// until ctx is cancelled. This is the long-running counterpart to the
+// one-shot probe/announce done by mdnsAnnounceContext, mirroring how
+// respondToQueries backs the custom protocol's Announce.
+func mdnsRespond(ctx context.Context, ip net.IP, instance string, msg *dns.Msg) {
+	network, addr := "udp4", mdnsV4Addr
+	if ip.To4() == nil {
+		network, addr = "udp6", mdnsV6Addr
+	}
+
+	group, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		log.Printf("mdns respond: %v", err)
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP(network, nil, group)
+	if err != nil {
+		log.Printf("mdns respond: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(MaxDatagramSize)
+
+	closed := make(chan struct{})
+	defer close(closed)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			default:
+				log.Printf("mdns respond: read: %v", err)
+			}
+
+			return
+		}
+
+		question := new(dns.Msg)
+		if err := question.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		for _, q := range question.Question {
+			if q.Name != instance {
+				continue
+			}
+
+			if err := mdnsSend(ip, msg); err != nil {
+				log.Printf("mdns respond: %v", err)
+			}
+
+			break
+		}
+	}
+}
+
+// mdnsAnnounceMsg builds the PTR/SRV/TXT/A(AAAA) answer set for a
+// service instance, with the cache-flush bit set as required for
+// announcements (RFC 6762 §10.2).
+func mdnsAnnounceMsg(instance, hostFQDN string, ip net.IP, port uint16, meta map[string]string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Authoritative = true
+
+	ptr := &dns.PTR{
+		Hdr: dns.RR_Header{Name: mdnsServiceType, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: mdnsTTL},
+		Ptr: instance,
+	}
+
+	srv := &dns.SRV{
+		Hdr:      dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET | cacheFlushBit, Ttl: mdnsTTL},
+		Priority: 0,
+		Weight:   0,
+		Port:     port,
+		Target:   hostFQDN,
+	}
+
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET | cacheFlushBit, Ttl: mdnsTTL},
+		Txt: encodeTXT(meta),
+	}
+
+	msg.Answer = append(msg.Answer, ptr, srv, txt)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: hostFQDN, Rrtype: dns.TypeA, Class: dns.ClassINET | cacheFlushBit, Ttl: mdnsTTL},
+			A:   ip4,
+		})
+	} else {
+		msg.Answer = append(msg.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: hostFQDN, Rrtype: dns.TypeAAAA, Class: dns.ClassINET | cacheFlushBit, Ttl: mdnsTTL},
+			AAAA: ip,
+		})
+	}
+
+	return msg
+}
+
+// cacheFlushBit is the top bit of the resource record class field used
+// by mDNS responders to mark a record as authoritative (RFC 6762 §10.2).
+const cacheFlushBit = 1 << 15
+
+// mdnsProbe sends a single RFC 6762 §8.1 probe query for instance and
+// reports whether a conflicting answer was seen within mdnsProbeTTL.
+// The probing socket joins the mDNS group itself (rather than just
+// sending to it), since a conflicting announcer's reply arrives over
+// multicast and a non-member socket would never see it.
+func mdnsProbe(instance string) (conflict bool, err error) {
+	msg := new(dns.Msg)
+	msg.Question = []dns.Question{{Name: instance, Qtype: dns.TypeANY, Qclass: dns.ClassINET}}
+
+	dst, err := net.ResolveUDPAddr("udp4", mdnsV4Addr)
+	if err != nil {
+		return false, err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, dst)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(MaxDatagramSize)
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := conn.WriteToUDP(packed, dst); err != nil {
+		return false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mdnsProbeTTL))
+
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return false, nil
+		}
+
+		reply := new(dns.Msg)
+		if err := reply.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		for _, rr := range reply.Answer {
+			if rr.Header().Name == instance {
+				return true, nil
+			}
+		}
+	}
+}
+
+// mdnsQueryContext sends a PTR question for name and waits until ctx is
+// done for a matching PTR/SRV/A(AAAA) answer set, honoring the
+// unicast-response (QU) bit so well-behaved responders can reply
+// directly instead of over multicast. The querying socket also joins
+// the mDNS group, since a multicast reply would otherwise never reach
+// a non-member socket, matching mdnsProbe and mdnsRespond.
+func mdnsQueryContext(ctx context.Context, name string) (Service, error) {
+	instance := instanceFQDN(name)
+
+	dst, err := net.ResolveUDPAddr("udp4", mdnsV4Addr)
+	if err != nil {
+		return Service{}, fmt.Errorf("mdns query: %v", err)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, dst)
+	if err != nil {
+		return Service{}, fmt.Errorf("mdns query: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(MaxDatagramSize)
+
+	msg := new(dns.Msg)
+	msg.Question = []dns.Question{{Name: instance, Qtype: dns.TypePTR, Qclass: dns.ClassINET | cacheFlushBit}}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return Service{}, fmt.Errorf("mdns query: %v", err)
+	}
+
+	if _, err := conn.WriteToUDP(packed, dst); err != nil {
+		return Service{}, fmt.Errorf("mdns query: %v", err)
+	}
+
+	closed := make(chan struct{})
+	defer close(closed)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return Service{}, ErrTimeout
+		}
+
+		reply := new(dns.Msg)
+		if err := reply.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		if svc, ok := serviceFromAnswers(reply.Answer); ok && svc.Name == instance {
+			return svc, nil
+		}
+	}
+}
+
+// serviceFromAnswers extracts a Service out of an mDNS answer set that
+// contains at least an SRV record and an A or AAAA record. The address
+// record's name is not checked against the SRV target.
+func serviceFromAnswers(answers []dns.RR) (Service, bool) {
+	var srv *dns.SRV
+	var addr net.IP
+	var name string
+	var meta map[string]string
+
+	for _, rr := range answers {
+		switch r := rr.(type) {
+		case *dns.PTR:
+			name = r.Ptr
+		case *dns.SRV:
+			srv = r
+		case *dns.A:
+			addr = r.A
+		case *dns.AAAA:
+			addr = r.AAAA
+		case *dns.TXT:
+			meta = decodeTXT(r.Txt)
+		}
+	}
+
+	if srv == nil || addr == nil {
+		return Service{}, false
+	}
+
+	if name == "" {
+		name = srv.Hdr.Name
+	}
+
+	return Service{
+		Name: name,
+		Addr: net.JoinHostPort(addr.String(), strconv.Itoa(int(srv.Port))),
+		Meta: meta,
+	}, true
+}
+
+// decodeTXT is the inverse of encodeTXT.
+func decodeTXT(txt []string) map[string]string {
+	if len(txt) == 0 {
+		return nil
+	}
+
+	meta := make(map[string]string, len(txt))
+	for _, kv := range txt {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		meta[parts[0]] = parts[1]
+	}
+
+	return meta
+}
+
+// mdnsSend packs and multicasts msg over the mDNS group matching ip's
+// address family.
+func mdnsSend(ip net.IP, msg *dns.Msg) error {
+	network, addr := "udp4", mdnsV4Addr
+	if ip.To4() == nil {
+		network, addr = "udp6", mdnsV6Addr
+	}
+
+	dst, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return err
+	}
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialUDP(network, nil, dst)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(packed)
+
+	return err
+}
+
+// encodeTXT turns a metadata map into the "key=value" strings used by
+// DNS-SD TXT records (RFC 6763 §6).
+func encodeTXT(meta map[string]string) []string {
+	if len(meta) == 0 {
+		return nil
+	}
+
+	txt := make([]string, 0, len(meta))
+	for k, v := range meta {
+		txt = append(txt, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	return txt
+}
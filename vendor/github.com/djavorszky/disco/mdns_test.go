@@ -0,0 +1,21 @@
+package disco
+
+import "testing"
+
+func TestInstanceFQDN(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"probe-svc", "probe-svc._disco._tcp.local."},
+		{"already.dotted.", "already.dotted._disco._tcp.local."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := instanceFQDN(tt.name); got != tt.want {
+				t.Errorf("instanceFQDN(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package disco
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType describes what happened to a Service tracked by a Registry.
+type EventType int
+
+const (
+	// Added indicates a service that wasn't previously known (or had
+	// expired and has now re-announced itself).
+	Added EventType = iota
+
+	// Removed indicates a service whose TTL passed without a refreshing
+	// announcement, i.e. a "goodbye".
+	Removed
+)
+
+// Event describes a change to a Registry's view of the fleet.
+type Event struct {
+	Type    EventType
+	Service Service
+}
+
+type registryEntry struct {
+	service  Service
+	deadline time.Time
+}
+
+// Registry maintains a continuously-correct view of the services
+// announced on a multicast address, built on top of Subscribe. Every
+// announcement refreshes the service's deadline, a background goroutine
+// periodically broadcasts a TypeReport message so peers re-announce, and
+// entries whose deadline passes without a refresh are removed and
+// surfaced as Removed events on Changes().
+type Registry struct {
+	mAddr string
+	ttl   time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	services map[string]registryEntry
+
+	changes chan Event
+}
+
+// NewRegistry starts a Registry tracking services announced on mAddr.
+// ttl is how long a service is kept alive after its most recent
+// announcement before it's considered gone; reportEvery is how often the
+// registry broadcasts a TypeReport message asking the network to
+// re-announce. Call Close to stop it.
+func NewRegistry(mAddr string, ttl, reportEvery time.Duration) (*Registry, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	msgs, err := SubscribeContext(ctx, mAddr)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("registry: %v", err)
+	}
+
+	r := &Registry{
+		mAddr:    mAddr,
+		ttl:      ttl,
+		cancel:   cancel,
+		services: make(map[string]registryEntry),
+		changes:  make(chan Event),
+	}
+
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		r.receive(ctx, msgs)
+	}()
+	go func() {
+		defer r.wg.Done()
+		r.maintain(ctx, reportEvery)
+	}()
+
+	return r, nil
+}
+
+// Changes returns a channel of Added/Removed events reflecting how the
+// registry's view of the fleet evolves over time. It is closed once
+// Close has fully stopped the registry.
+func (r *Registry) Changes() <-chan Event {
+	return r.changes
+}
+
+// Lookup returns every currently-alive instance of name known to the
+// registry, or nil if there are none.
+func (r *Registry) Lookup(name string) []Service {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var found []Service
+	for _, e := range r.services {
+		if e.service.Name == name {
+			found = append(found, e.service)
+		}
+	}
+
+	return found
+}
+
+// All returns every service currently known to the registry.
+func (r *Registry) All() []Service {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make([]Service, 0, len(r.services))
+	for _, e := range r.services {
+		all = append(all, e.service)
+	}
+
+	return all
+}
+
+// Close stops the registry's background goroutines, releases its UDP
+// socket and closes Changes().
+func (r *Registry) Close() {
+	r.cancel()
+	r.wg.Wait()
+	close(r.changes)
+}
+
+func (r *Registry) receive(ctx context.Context, msgs <-chan MulticastMsg) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+
+			service, err := srvcFrom(msg.Message)
+			if err != nil {
+				continue
+			}
+
+			// A service only emits a fresh TypeAnnounce once, at
+			// startup; maintain's periodic TypeReport is answered with
+			// a TypeResponse (see respondToQueries), so both count as
+			// proof of life.
+			if service.typ != TypeAnnounce && service.typ != TypeResponse {
+				continue
+			}
+
+			r.refresh(ctx, Service{Name: service.name, Addr: service.srcAddr, Meta: service.meta})
+		}
+	}
+}
+
+func (r *Registry) refresh(ctx context.Context, svc Service) {
+	key := svc.Name + "|" + svc.Addr
+
+	r.mu.Lock()
+	_, existed := r.services[key]
+	r.services[key] = registryEntry{service: svc, deadline: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+
+	if !existed {
+		r.emit(ctx, Event{Type: Added, Service: svc})
+	}
+}
+
+// maintain periodically asks the network to re-announce via a TypeReport
+// broadcast and sweeps entries whose TTL has lapsed.
+func (r *Registry) maintain(ctx context.Context, reportEvery time.Duration) {
+	report := time.NewTicker(reportEvery)
+	defer report.Stop()
+
+	sweepEvery := r.ttl / 4
+	if sweepEvery <= 0 {
+		sweepEvery = time.Second
+	}
+
+	sweep := time.NewTicker(sweepEvery)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-report.C:
+			// srcAddr/name are placeholders: respondToQueries and peers
+			// only key off the TypeReport type, not these fields, but
+			// the wire format requires them to be non-empty.
+			msg := srvc{typ: TypeReport, srcAddr: "-", name: "-"}
+			if err := Broadcast(r.mAddr, msg.String()); err != nil {
+				// Best-effort; the next tick will try again.
+				continue
+			}
+		case <-sweep.C:
+			r.sweepExpired(ctx)
+		}
+	}
+}
+
+func (r *Registry) sweepExpired(ctx context.Context) {
+	now := time.Now()
+
+	r.mu.Lock()
+	var expired []Service
+	for key, e := range r.services {
+		if now.After(e.deadline) {
+			expired = append(expired, e.service)
+			delete(r.services, key)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, svc := range expired {
+		r.emit(ctx, Event{Type: Removed, Service: svc})
+	}
+}
+
+func (r *Registry) emit(ctx context.Context, ev Event) {
+	select {
+	case r.changes <- ev:
+	case <-ctx.Done():
+	}
+}
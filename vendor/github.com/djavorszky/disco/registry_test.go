@@ -0,0 +1,85 @@
+package disco
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRegistrySweepExpired(t *testing.T) {
+	r := &Registry{
+		ttl: time.Minute,
+		services: map[string]registryEntry{
+			"svc|addr": {
+				service:  Service{Name: "svc", Addr: "addr"},
+				deadline: time.Now().Add(-time.Second),
+			},
+		},
+		changes: make(chan Event, 1),
+	}
+
+	r.sweepExpired(context.Background())
+
+	select {
+	case ev := <-r.changes:
+		if ev.Type != Removed || ev.Service.Name != "svc" {
+			t.Errorf("sweepExpired emitted %+v, want Removed svc", ev)
+		}
+	default:
+		t.Error("sweepExpired did not emit a Removed event for the expired entry")
+	}
+
+	if len(r.services) != 0 {
+		t.Errorf("sweepExpired left %d services behind, want 0", len(r.services))
+	}
+}
+
+func TestRegistryRefreshEmitsAddedOnce(t *testing.T) {
+	r := &Registry{
+		ttl:      time.Minute,
+		services: make(map[string]registryEntry),
+		changes:  make(chan Event, 2),
+	}
+
+	svc := Service{Name: "svc", Addr: "addr"}
+	ctx := context.Background()
+
+	r.refresh(ctx, svc)
+	r.refresh(ctx, svc)
+
+	if len(r.changes) != 1 {
+		t.Fatalf("refresh emitted %d events for repeat announcements, want 1", len(r.changes))
+	}
+
+	if ev := <-r.changes; ev.Type != Added || !reflect.DeepEqual(ev.Service, svc) {
+		t.Errorf("refresh emitted %+v, want Added %+v", ev, svc)
+	}
+}
+
+// TestRegistryReceiveRefreshesOnTypeResponse covers the report/refresh
+// round trip: maintain's periodic TypeReport is answered with a
+// TypeResponse (see respondToQueries), and receive must treat that as
+// proof of life, not just a fresh TypeAnnounce.
+func TestRegistryReceiveRefreshesOnTypeResponse(t *testing.T) {
+	r := &Registry{
+		ttl:      time.Minute,
+		services: make(map[string]registryEntry),
+		changes:  make(chan Event, 1),
+	}
+
+	msgs := make(chan MulticastMsg, 1)
+	msgs <- MulticastMsg{Message: srvc{typ: TypeResponse, srcAddr: "addr", name: "svc"}.String()}
+	close(msgs)
+
+	r.receive(context.Background(), msgs)
+
+	select {
+	case ev := <-r.changes:
+		if ev.Type != Added || ev.Service.Name != "svc" {
+			t.Errorf("receive emitted %+v, want Added svc", ev)
+		}
+	default:
+		t.Error("receive did not refresh the registry on a TypeResponse message")
+	}
+}